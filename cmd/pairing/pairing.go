@@ -23,6 +23,10 @@ import (
 	"net/url"
 	"path"
 	"time"
+
+	astartectlutils "github.com/astarte-platform/astartectl/utils"
+	"github.com/astarte-platform/astartectl/utils/kms"
+	"github.com/astarte-platform/astartectl/utils/oidc"
 )
 
 // pairingCmd represents the pairing command
@@ -42,12 +46,29 @@ func init() {
 		"Path to realm private key used to generate JWT for authentication")
 	PairingCmd.MarkPersistentFlagFilename("realm-key")
 	viper.BindPFlag("realm.key", PairingCmd.PersistentFlags().Lookup("realm-key"))
+	PairingCmd.PersistentFlags().String("realm-kms", "",
+		`URI of a realm key living in an HSM or smartcard, used in place of --realm-key to generate the authentication JWT.
+Only RSA and EC keys are supported; PKCS#11 has no standard mechanism for Ed25519.`)
+	viper.BindPFlag("realm.kms", PairingCmd.PersistentFlags().Lookup("realm-kms"))
+	PairingCmd.PersistentFlags().Bool("realm-kms-rsa-pss", false,
+		`Sign with RSASSA-PSS (PS256) instead of RSASSA-PKCS1-v1_5 (RS256) when --realm-kms resolves to an RSA key.`)
+	viper.BindPFlag("realm.kms-rsa-pss", PairingCmd.PersistentFlags().Lookup("realm-kms-rsa-pss"))
 	PairingCmd.PersistentFlags().String("pairing-url", "",
 		"Pairing API base URL. Defaults to <astarte-url>/pairing.")
 	viper.BindPFlag("pairing.url", PairingCmd.PersistentFlags().Lookup("pairing-url"))
 	PairingCmd.PersistentFlags().StringP("realm-name", "r", "",
 		"The name of the realm that will be queried")
 	viper.BindPFlag("realm.name", PairingCmd.PersistentFlags().Lookup("realm-name"))
+
+	PairingCmd.PersistentFlags().String("oidc-issuer", "",
+		"Issuer URL of an OIDC provider to authenticate against, in place of a realm key.")
+	viper.BindPFlag("oidc.issuer", PairingCmd.PersistentFlags().Lookup("oidc-issuer"))
+	PairingCmd.PersistentFlags().String("oidc-client-id", "",
+		"Client ID to use when authenticating against --oidc-issuer.")
+	viper.BindPFlag("oidc.client-id", PairingCmd.PersistentFlags().Lookup("oidc-client-id"))
+	PairingCmd.PersistentFlags().String("oidc-client-secret", "",
+		"Client secret to use when authenticating against --oidc-issuer. Can be left empty for public clients using the device code flow.")
+	viper.BindPFlag("oidc.client-secret", PairingCmd.PersistentFlags().Lookup("oidc-client-secret"))
 }
 
 func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
@@ -64,18 +85,39 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 		return errors.New("Either astarte-url or pairing-url have to be specified")
 	}
 
-	pairingKey := viper.GetString("realm.key")
-	if pairingKey == "" {
-		return errors.New("realm-key is required")
-	}
-
 	realm = viper.GetString("realm.name")
 	if realm == "" {
 		return errors.New("realm is required")
 	}
 
+	oidcIssuer := viper.GetString("oidc.issuer")
+	if oidcIssuer != "" {
+		oidcConfig := oidc.Config{
+			Issuer:       oidcIssuer,
+			ClientID:     viper.GetString("oidc.client-id"),
+			ClientSecret: viper.GetString("oidc.client-secret"),
+		}
+		if oidcConfig.ClientID == "" {
+			return errors.New("oidc-client-id is required when oidc-issuer is specified")
+		}
+
+		token, err := oidcConfig.Token()
+		if err != nil {
+			return err
+		}
+		pairingJwt = token
+
+		return nil
+	}
+
+	pairingKey := viper.GetString("realm.key")
+	pairingKms := viper.GetString("realm.kms")
+	if pairingKey == "" && pairingKms == "" {
+		return errors.New("either realm-key, realm-kms or oidc-issuer is required")
+	}
+
 	var err error
-	pairingJwt, err = generatePairingJWT(pairingKey)
+	pairingJwt, err = generatePairingJWT(pairingKey, pairingKms, viper.GetBool("realm.kms-rsa-pss"))
 	if err != nil {
 		return err
 	}
@@ -83,21 +125,37 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func generatePairingJWT(privateKey string) (jwtString string, err error) {
-	keyPEM, err := ioutil.ReadFile(privateKey)
-	if err != nil {
-		return "", err
-	}
+func generatePairingJWT(privateKey, kmsURI string, rsaPSS bool) (jwtString string, err error) {
+	var key interface{}
+	var signingMethod jwt.SigningMethod
 
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
-	if err != nil {
-		return "", err
+	if kmsURI != "" {
+		signer, err := kms.ResolveSigner(kmsURI)
+		if err != nil {
+			return "", err
+		}
+
+		signingMethod, err = astartectlutils.SigningMethodForSigner(signer, rsaPSS)
+		if err != nil {
+			return "", err
+		}
+		key = signer
+	} else {
+		keyPEM, err := ioutil.ReadFile(privateKey)
+		if err != nil {
+			return "", err
+		}
+
+		key, signingMethod, err = astartectlutils.SigningKeyFromPEM(keyPEM)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	now := time.Now().UTC().Unix()
 	// 5 minutes expiry
 	expiry := now + 300
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(signingMethod, jwt.MapClaims{
 		"a_pa": []string{"^.*$::^.*$"},
 		"iat":  now,
 		"exp":  expiry,
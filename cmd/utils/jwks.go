@@ -0,0 +1,85 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	astartectlutils "github.com/astarte-platform/astartectl/utils"
+)
+
+var jwksExportCmd = &cobra.Command{
+	Use:   "jwks-export <key.pem>...",
+	Short: "Export realm public keys as a JWKS",
+	Long: `Export one or more PEM encoded public keys (or private keys, from which the public half
+is derived) as a JSON Web Key Set (JWKS), as defined by RFC 7517.
+
+Each key's kid is computed as its RFC 7638 JWK thumbprint, so components and third-party
+verifiers can match a JWT's kid header against the right entry when rotating keys.`,
+	Example: `  astartectl utils jwks-export test-realm_public.pem`,
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    jwksExportF,
+}
+
+func init() {
+	jwksExportCmd.Flags().StringP("output", "o", "", "File to write the JWKS to. Defaults to stdout.")
+	jwksExportCmd.MarkFlagFilename("output")
+
+	UtilsCmd.AddCommand(jwksExportCmd)
+}
+
+func jwksExportF(command *cobra.Command, args []string) error {
+	jwkSet := astartectlutils.JWKSet{}
+
+	for _, keyFile := range args {
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+
+		publicKey, err := astartectlutils.PublicKeyFromPEM(keyPEM)
+		if err != nil {
+			return err
+		}
+
+		jwk, err := astartectlutils.JWKFromPublicKey(publicKey)
+		if err != nil {
+			return err
+		}
+
+		jwkSet.Keys = append(jwkSet.Keys, jwk)
+	}
+
+	jwksJSON, err := json.MarshalIndent(jwkSet, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	output, err := command.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		fmt.Println(string(jwksJSON))
+		return nil
+	}
+
+	return ioutil.WriteFile(output, jwksJSON, 0644)
+}
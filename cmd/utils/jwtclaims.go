@@ -0,0 +1,90 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// devicePathPatterns maps a jwt type to the regex matching every path scoped to a single
+// device, for the APIs that expose device-scoped endpoints. --allow-device expands into this
+// pattern, with the device id substituted in.
+var devicePathPatterns = map[string]string{
+	"appengine": "/v1/[^/]+/devices/%s(/.*)?",
+	"pairing":   "/v1/[^/]+/devices/%s(/.*)?",
+	"channels":  "/v1/[^/]+/devices/%s(/.*)?",
+}
+
+// genJwtArgs validates gen-jwt's positional type argument: required, unless --all-apis was
+// passed, in which case it must be absent.
+func genJwtArgs(cmd *cobra.Command, args []string) error {
+	allAPIs, err := cmd.Flags().GetBool("all-apis")
+	if err != nil {
+		return err
+	}
+
+	if allAPIs {
+		return cobra.NoArgs(cmd, args)
+	}
+	return cobra.ExactArgs(1)(cmd, args)
+}
+
+// accessClaimsForType builds the list of a_* access claims for jwtType out of the --claims,
+// --allow and --allow-device flags, falling back to defaultClaims (all-access) when none of
+// them were specified.
+func accessClaimsForType(command *cobra.Command, jwtType string) ([]string, error) {
+	var accessClaims []string
+
+	if command.Flags().Changed("claims") {
+		claims, err := command.Flags().GetStringSlice("claims")
+		if err != nil {
+			return nil, err
+		}
+		accessClaims = append(accessClaims, claims...)
+	}
+
+	allow, err := command.Flags().GetStringSlice("allow")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range allow {
+		method, path, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid --allow %q, expected METHOD:PATH", entry)
+		}
+		accessClaims = append(accessClaims, method+"::"+path)
+	}
+
+	allowDevice, err := command.Flags().GetStringSlice("allow-device")
+	if err != nil {
+		return nil, err
+	}
+	for _, deviceID := range allowDevice {
+		pathPattern, ok := devicePathPatterns[jwtType]
+		if !ok {
+			return nil, fmt.Errorf("--allow-device is not supported for the %s API", jwtType)
+		}
+		accessClaims = append(accessClaims, fmt.Sprintf(".*::"+pathPattern, deviceID))
+	}
+
+	if len(accessClaims) == 0 {
+		accessClaims = defaultClaims
+	}
+
+	return accessClaims, nil
+}
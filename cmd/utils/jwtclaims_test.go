@@ -0,0 +1,130 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// newTestJwtCmd builds a bare cobra.Command carrying the subset of gen-jwt's flags that
+// accessClaimsForType reads, without pulling in the rest of genJwtCmd's init().
+func newTestJwtCmd() *cobra.Command {
+	cmd := &cobra.Command{}
+	cmd.Flags().StringSliceP("claims", "c", defaultClaims, "")
+	cmd.Flags().StringSlice("allow", nil, "")
+	cmd.Flags().StringSlice("allow-device", nil, "")
+	return cmd
+}
+
+func TestAccessClaimsForType(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwtType string
+		setup   func(cmd *cobra.Command) error
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no flags falls back to defaultClaims",
+			jwtType: "appengine",
+			setup:   func(cmd *cobra.Command) error { return nil },
+			want:    defaultClaims,
+		},
+		{
+			name:    "--claims overrides the default",
+			jwtType: "appengine",
+			setup: func(cmd *cobra.Command) error {
+				return cmd.Flags().Set("claims", "GET::/devices/.*")
+			},
+			want: []string{"GET::/devices/.*"},
+		},
+		{
+			name:    "--allow expands METHOD:PATH into a METHOD::PATH claim",
+			jwtType: "appengine",
+			setup: func(cmd *cobra.Command) error {
+				return cmd.Flags().Set("allow", "GET:/devices/.*")
+			},
+			want: []string{"GET::/devices/.*"},
+		},
+		{
+			name:    "--allow without a colon is rejected",
+			jwtType: "appengine",
+			setup: func(cmd *cobra.Command) error {
+				return cmd.Flags().Set("allow", "GET/devices/.*")
+			},
+			wantErr: true,
+		},
+		{
+			name:    "--allow-device expands into the API's device path pattern",
+			jwtType: "appengine",
+			setup: func(cmd *cobra.Command) error {
+				return cmd.Flags().Set("allow-device", "some-device-id")
+			},
+			want: []string{".*::/v1/[^/]+/devices/some-device-id(/.*)?"},
+		},
+		{
+			name:    "--allow-device on an API without device-scoped paths is rejected",
+			jwtType: "realm-management",
+			setup: func(cmd *cobra.Command) error {
+				return cmd.Flags().Set("allow-device", "some-device-id")
+			},
+			wantErr: true,
+		},
+		{
+			name:    "--claims, --allow and --allow-device combine",
+			jwtType: "channels",
+			setup: func(cmd *cobra.Command) error {
+				if err := cmd.Flags().Set("claims", "GET::/devices/.*"); err != nil {
+					return err
+				}
+				if err := cmd.Flags().Set("allow", "POST:/groups/.*"); err != nil {
+					return err
+				}
+				return cmd.Flags().Set("allow-device", "some-device-id")
+			},
+			want: []string{
+				"GET::/devices/.*",
+				"POST::/groups/.*",
+				".*::/v1/[^/]+/devices/some-device-id(/.*)?",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newTestJwtCmd()
+			if err := tt.setup(cmd); err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+
+			got, err := accessClaimsForType(cmd, tt.jwtType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("accessClaimsForType() expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("accessClaimsForType() returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("accessClaimsForType() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
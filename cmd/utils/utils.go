@@ -19,6 +19,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -30,6 +34,9 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	astartectlutils "github.com/astarte-platform/astartectl/utils"
+	"github.com/astarte-platform/astartectl/utils/kms"
 )
 
 // utilsCmd represents the utils command
@@ -39,10 +46,12 @@ var UtilsCmd = &cobra.Command{
 	Long:  `utils includes commands to generate keypairs and device ids`,
 }
 
+var validKeypairAlgorithms = []string{"rsa", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
 var genKeypairCmd = &cobra.Command{
 	Use:   "gen-keypair <realm_name>",
-	Short: "Generate an RSA keypair",
-	Long: `Generate an RSA keypair to use for realm authentication.
+	Short: "Generate a keypair",
+	Long: `Generate a keypair to use for realm authentication.
 
 The keypair will be saved in the current directory with names <realm_name>_private.pem and <realm_name>_public.pem`,
 	Example: `  astartectl utils gen-keypair myrealm`,
@@ -69,11 +78,14 @@ var jwtTypesToClaim = map[string]string{
 var jwtTypes = []string{"housekeeping", "realm-management", "pairing", "appengine", "channels"}
 
 var genJwtCmd = &cobra.Command{
-	Use:       "gen-jwt <type>",
-	Short:     "Generate a JWT",
-	Long:      `Generate a JWT to access one of astarte APIs.`,
+	Use:   "gen-jwt [type]",
+	Short: "Generate a JWT",
+	Long: `Generate a JWT to access one of astarte APIs.
+
+type is required unless --all-apis is specified, in which case every API's claim is added to
+the token, which is useful to generate admin tokens.`,
 	Example:   `  astartectl utils gen-jwt realm-management -p test-realm.key`,
-	Args:      cobra.ExactArgs(1),
+	Args:      genJwtArgs,
 	ValidArgs: jwtTypes,
 	RunE:      genJwtF,
 }
@@ -81,13 +93,34 @@ var genJwtCmd = &cobra.Command{
 var defaultClaims = []string{".*::.*"}
 
 func init() {
+	genKeypairCmd.Flags().StringP("algorithm", "a", "rsa", `Algorithm to use for the keypair. Valid values are: rsa, ecdsa-p256, ecdsa-p384, ed25519.`)
+	genKeypairCmd.Flags().Int("key-size", 4096, "Size in bits of the generated key. Only used when --algorithm is rsa.")
+
 	genJwtCmd.Flags().StringP("private-key", "p", "", `Path to PEM encoded private key.
-Should be Housekeeping key to generate an housekeeping token, Realm key for everything else.`)
-	genJwtCmd.MarkFlagRequired("private-key")
+Should be Housekeeping key to generate an housekeeping token, Realm key for everything else.
+Ignored when --kms is specified.`)
 	genJwtCmd.MarkFlagFilename("private-key")
+	genJwtCmd.Flags().String("kms", "", `URI of a key living in an HSM or smartcard to sign the JWT with, e.g.
+pkcs11:token=astarte;object=realm-key?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234
+Takes precedence over --private-key. Only RSA and EC keys are supported; PKCS#11 has no standard
+mechanism for Ed25519.`)
+	genJwtCmd.Flags().Bool("rsa-pss", false, `Sign with RSASSA-PSS (PS256) instead of RSASSA-PKCS1-v1_5 (RS256) when --kms
+resolves to an RSA key. Ignored for EC, Ed25519 and --private-key keys.`)
 	genJwtCmd.Flags().StringSliceP("claims", "c", defaultClaims, `The list of claims to be added in the JWT. Defaults to .*::.* (i.e. all-access)
 You can specify the flag multiple times or separate the claims with a comma.`)
+	genJwtCmd.Flags().StringSlice("allow", nil, `Grant access to a single METHOD:PATH couple, e.g. --allow "GET:/devices/.*"
+Can be specified multiple times, and combined with --claims and --allow-device.`)
+	genJwtCmd.Flags().StringSlice("allow-device", nil, `Grant access to every path scoped to the given device id, for APIs that support it
+(appengine, pairing, channels). Can be specified multiple times.`)
+	genJwtCmd.Flags().Bool("all-apis", false, "Emit the access claim for every Astarte API, rather than just type. Useful for admin tokens.")
 	genJwtCmd.Flags().Int64P("expiry", "e", 300, "Expiration time of the token in seconds. 0 means the token will never expire.")
+	genJwtCmd.Flags().Int64("not-before", 0, "Time, in seconds from now, before which the token must not be accepted. 0 means the token is valid immediately.")
+	genJwtCmd.Flags().String("issuer", "", "Value of the iss claim.")
+	genJwtCmd.Flags().String("subject", "", "Value of the sub claim.")
+	genJwtCmd.Flags().StringSlice("audience", nil, "Value of the aud claim. Can be specified multiple times for a multi-valued audience.")
+	genJwtCmd.Flags().String("jti", "", "Value of the jti claim. Defaults to a randomly generated UUID.")
+	genJwtCmd.Flags().String("kid", "", `kid to set in the JWT header, so verifiers can pick the right key out of a JWKS
+when rotating keys. Defaults to the signing key's RFC 7638 JWK thumbprint.`)
 
 	UtilsCmd.AddCommand(genKeypairCmd)
 	UtilsCmd.AddCommand(genDeviceIdCmd)
@@ -97,21 +130,72 @@ You can specify the flag multiple times or separate the claims with a comma.`)
 func genKeypairF(command *cobra.Command, args []string) error {
 	realm := args[0]
 
-	reader := rand.Reader
-	bitSize := 4096
-
-	key, err := rsa.GenerateKey(reader, bitSize)
+	algorithm, err := command.Flags().GetString("algorithm")
 	if err != nil {
 		return err
 	}
-	checkError(err)
 
-	publicKey := key.PublicKey
+	var privateKeyType string
+	var privateKeyBytes []byte
+	var publicKey interface{}
+
+	switch algorithm {
+	case "rsa":
+		keySize, err := command.Flags().GetInt("key-size")
+		if err != nil {
+			return err
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, keySize)
+		if err != nil {
+			return err
+		}
+
+		privateKeyType = "RSA PRIVATE KEY"
+		privateKeyBytes = x509.MarshalPKCS1PrivateKey(key)
+		publicKey = &key.PublicKey
+	case "ecdsa-p256", "ecdsa-p384":
+		curve := elliptic.P256()
+		if algorithm == "ecdsa-p384" {
+			curve = elliptic.P384()
+		}
+
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		privateKeyBytes, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		privateKeyType = "EC PRIVATE KEY"
+		publicKey = &key.PublicKey
+	case "ed25519":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		privateKeyBytes, err = x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		privateKeyType = "PRIVATE KEY"
+		publicKey = pub
+	default:
+		return fmt.Errorf("invalid algorithm %s. Valid algorithms are: %s", algorithm, strings.Join(validKeypairAlgorithms, ", "))
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Keypair generated successfully")
 
-	savePEMKey(realm+"_private.pem", key)
-	savePublicPEMKey(realm+"_public.pem", publicKey)
+	savePEMKey(realm+"_private.pem", privateKeyType, privateKeyBytes)
+	savePEMKey(realm+"_public.pem", "PUBLIC KEY", publicKeyBytes)
 
 	return nil
 }
@@ -138,53 +222,160 @@ func validJwtType(t string) bool {
 }
 
 func genJwtF(command *cobra.Command, args []string) error {
-	jwtType := args[0]
-	if !validJwtType(jwtType) {
-		errorString := fmt.Sprintf("Invalid type. Valid types are: %s", strings.Join(jwtTypes, ", "))
+	allAPIs, err := command.Flags().GetBool("all-apis")
+	if err != nil {
+		return err
+	}
+
+	var jwtType string
+	if !allAPIs {
+		jwtType = args[0]
+		if !validJwtType(jwtType) {
+			errorString := fmt.Sprintf("Invalid type. Valid types are: %s", strings.Join(jwtTypes, ", "))
 
-		return errors.New(errorString)
+			return errors.New(errorString)
+		}
 	}
 
-	privateKey, err := command.Flags().GetString("private-key")
+	kmsURI, err := command.Flags().GetString("kms")
 	if err != nil {
 		return err
 	}
-
-	keyPEM, err := ioutil.ReadFile(privateKey)
+	rsaPSS, err := command.Flags().GetBool("rsa-pss")
 	if err != nil {
 		return err
 	}
 
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+	var key interface{}
+	var signingMethod jwt.SigningMethod
+
+	if kmsURI != "" {
+		signer, err := kms.ResolveSigner(kmsURI)
+		if err != nil {
+			return err
+		}
+
+		signingMethod, err = astartectlutils.SigningMethodForSigner(signer, rsaPSS)
+		if err != nil {
+			return err
+		}
+		key = signer
+	} else {
+		privateKey, err := command.Flags().GetString("private-key")
+		if err != nil {
+			return err
+		}
+		if privateKey == "" {
+			return errors.New("either --private-key or --kms must be specified")
+		}
+
+		keyPEM, err := ioutil.ReadFile(privateKey)
+		if err != nil {
+			return err
+		}
+
+		key, signingMethod, err = astartectlutils.SigningKeyFromPEM(keyPEM)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC().Unix()
+	claims := jwt.MapClaims{
+		"iat": now,
+	}
+
+	if allAPIs {
+		for _, t := range jwtTypes {
+			accessClaims, err := accessClaimsForType(command, t)
+			if err != nil {
+				return err
+			}
+			claims[jwtTypesToClaim[t]] = accessClaims
+		}
+	} else {
+		accessClaims, err := accessClaimsForType(command, jwtType)
+		if err != nil {
+			return err
+		}
+		claims[jwtTypesToClaim[jwtType]] = accessClaims
+	}
+
+	expiryOffset, err := command.Flags().GetInt64("expiry")
 	if err != nil {
 		return err
 	}
+	if expiryOffset != 0 {
+		claims["exp"] = now + expiryOffset
+	}
 
-	accessClaims, err := command.Flags().GetStringSlice("claims")
+	notBeforeOffset, err := command.Flags().GetInt64("not-before")
 	if err != nil {
 		return err
 	}
+	if notBeforeOffset != 0 {
+		claims["nbf"] = now + notBeforeOffset
+	}
 
-	accessClaimKey := jwtTypesToClaim[jwtType]
+	issuer, err := command.Flags().GetString("issuer")
+	if err != nil {
+		return err
+	}
+	if issuer != "" {
+		claims["iss"] = issuer
+	}
 
-	now := time.Now().UTC().Unix()
-	claims := jwt.MapClaims{
-		"iat": now,
+	subject, err := command.Flags().GetString("subject")
+	if err != nil {
+		return err
+	}
+	if subject != "" {
+		claims["sub"] = subject
 	}
 
-	claims[accessClaimKey] = accessClaims
+	audience, err := command.Flags().GetStringSlice("audience")
+	if err != nil {
+		return err
+	}
+	switch len(audience) {
+	case 0:
+	case 1:
+		claims["aud"] = audience[0]
+	default:
+		claims["aud"] = audience
+	}
 
-	expiryOffset, err := command.Flags().GetInt64("expiry")
+	jti, err := command.Flags().GetString("jti")
 	if err != nil {
 		return err
 	}
+	if jti == "" {
+		generatedJti, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		jti = generatedJti.String()
+	}
+	claims["jti"] = jti
 
-	if expiryOffset != 0 {
-		expiry := now + expiryOffset
-		claims["expiry"] = expiry
+	kid, err := command.Flags().GetString("kid")
+	if err != nil {
+		return err
+	}
+	if kid == "" {
+		if signer, ok := key.(crypto.Signer); ok {
+			jwk, err := astartectlutils.JWKFromPublicKey(signer.Public())
+			if err != nil {
+				return err
+			}
+			kid = jwk.Kid
+		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token := jwt.NewWithClaims(signingMethod, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
 
 	tokenString, err := token.SignedString(key)
 	if err != nil {
@@ -196,35 +387,17 @@ func genJwtF(command *cobra.Command, args []string) error {
 	return nil
 }
 
-func savePEMKey(fileName string, key *rsa.PrivateKey) {
+func savePEMKey(fileName string, blockType string, derBytes []byte) {
 	outFile, err := os.Create(fileName)
 	checkError(err)
 	defer outFile.Close()
 
-	var privateKey = &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	var block = &pem.Block{
+		Type:  blockType,
+		Bytes: derBytes,
 	}
 
-	err = pem.Encode(outFile, privateKey)
-	checkError(err)
-
-	fmt.Println("Wrote " + fileName)
-}
-
-func savePublicPEMKey(fileName string, pubkey rsa.PublicKey) {
-	pkixBytes, err := x509.MarshalPKIXPublicKey(&pubkey)
-	checkError(err)
-	var pemkey = &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pkixBytes,
-	}
-
-	pemfile, err := os.Create(fileName)
-	checkError(err)
-	defer pemfile.Close()
-
-	err = pem.Encode(pemfile, pemkey)
+	err = pem.Encode(outFile, block)
 	checkError(err)
 
 	fmt.Println("Wrote " + fileName)
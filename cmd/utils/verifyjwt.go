@@ -0,0 +1,203 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/cobra"
+
+	astartectlutils "github.com/astarte-platform/astartectl/utils"
+)
+
+var jwtClaimToType = func() map[string]string {
+	m := make(map[string]string, len(jwtTypesToClaim))
+	for t, claim := range jwtTypesToClaim {
+		m[claim] = t
+	}
+	return m
+}()
+
+var verifyJwtCmd = &cobra.Command{
+	Use:   "verify-jwt",
+	Short: "Verify a JWT and print its claims",
+	Long: `Verify a JWT's signature and standard claims (exp/nbf/iat), then pretty-print its decoded
+header and claims, along with which a_* access scopes it grants and against which Astarte APIs.
+
+The token is read from --token, or from stdin if --token is not specified.`,
+	Example: `  astartectl utils verify-jwt --public-key test-realm_public.pem --token "$TOKEN"`,
+	RunE:    verifyJwtF,
+}
+
+func init() {
+	verifyJwtCmd.Flags().String("token", "", "The JWT to verify. Defaults to reading it from stdin.")
+	verifyJwtCmd.Flags().String("public-key", "", `Path to a PEM encoded public key, or the URL of a JWKS, to verify the
+token's signature against. When a JWKS is used, the key is selected by the token's kid header.`)
+	verifyJwtCmd.MarkFlagRequired("public-key")
+	verifyJwtCmd.Flags().String("expected-audience", "", "If set, the token is rejected unless its aud claim contains this value.")
+	verifyJwtCmd.Flags().String("expected-issuer", "", "If set, the token is rejected unless its iss claim is exactly this value.")
+
+	UtilsCmd.AddCommand(verifyJwtCmd)
+}
+
+func verifyJwtF(command *cobra.Command, args []string) error {
+	tokenString, err := command.Flags().GetString("token")
+	if err != nil {
+		return err
+	}
+	if tokenString == "" {
+		tokenBytes, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		tokenString = strings.TrimSpace(string(tokenBytes))
+	}
+	if tokenString == "" {
+		return fmt.Errorf("no token provided, pass --token or pipe it through stdin")
+	}
+
+	publicKey, err := command.Flags().GetString("public-key")
+	if err != nil {
+		return err
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return resolvePublicKey(publicKey, token)
+	})
+	if err != nil {
+		return err
+	}
+	if !token.Valid {
+		return fmt.Errorf("token is not valid")
+	}
+
+	expectedAudience, err := command.Flags().GetString("expected-audience")
+	if err != nil {
+		return err
+	}
+	if expectedAudience != "" && !claimsHaveAudience(claims, expectedAudience) {
+		return fmt.Errorf("token does not carry the expected audience %q", expectedAudience)
+	}
+
+	expectedIssuer, err := command.Flags().GetString("expected-issuer")
+	if err != nil {
+		return err
+	}
+	if expectedIssuer != "" && !claims.VerifyIssuer(expectedIssuer, true) {
+		return fmt.Errorf("token does not carry the expected issuer %q", expectedIssuer)
+	}
+
+	headerJSON, err := json.MarshalIndent(token.Header, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println("Header:")
+	fmt.Println(string(headerJSON))
+
+	claimsJSON, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nClaims:")
+	fmt.Println(string(claimsJSON))
+
+	fmt.Println("\nGranted access:")
+	for claim, scopes := range claims {
+		jwtType, ok := jwtClaimToType[claim]
+		if !ok {
+			continue
+		}
+
+		accessClaims, ok := scopes.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, accessClaim := range accessClaims {
+			fmt.Printf("  %s: %v\n", jwtType, accessClaim)
+		}
+	}
+
+	return nil
+}
+
+// claimsHaveAudience reports whether claims' aud claim contains expectedAudience. It handles
+// both shapes RFC 7519 allows: a single string, or an array of strings (decoded by
+// encoding/json as []interface{}) — jwt.MapClaims.VerifyAudience only understands the former
+// and always fails closed against the latter.
+func claimsHaveAudience(claims jwt.MapClaims, expectedAudience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == expectedAudience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == expectedAudience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolvePublicKey returns the key the JWT was allegedly signed with, either parsing publicKey
+// as a PEM file, or fetching it as a JWKS URL and picking the key matching token's kid header.
+func resolvePublicKey(publicKey string, token *jwt.Token) (crypto.PublicKey, error) {
+	if strings.HasPrefix(publicKey, "http://") || strings.HasPrefix(publicKey, "https://") {
+		return publicKeyFromJWKSURL(publicKey, token)
+	}
+
+	keyPEM, err := ioutil.ReadFile(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return astartectlutils.PublicKeyFromPEM(keyPEM)
+}
+
+func publicKeyFromJWKSURL(jwksURL string, token *jwt.Token) (crypto.PublicKey, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, fmt.Errorf("token has no kid header, cannot select a key out of the JWKS")
+	}
+
+	resp, err := http.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch JWKS from %s: HTTP %d", jwksURL, resp.StatusCode)
+	}
+
+	var jwkSet astartectlutils.JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&jwkSet); err != nil {
+		return nil, err
+	}
+
+	for _, jwk := range jwkSet.Keys {
+		if jwk.Kid == kid {
+			return jwk.PublicKey()
+		}
+	}
+
+	return nil, fmt.Errorf("no key with kid %q found in JWKS at %s", kid, jwksURL)
+}
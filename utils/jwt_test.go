@@ -0,0 +1,117 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func pemEncode(t *testing.T, blockType string, der []byte) []byte {
+	t.Helper()
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestSigningKeyFromPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	ecKey256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate P-256 key: %v", err)
+	}
+	ecDER256, err := x509.MarshalECPrivateKey(ecKey256)
+	if err != nil {
+		t.Fatalf("failed to marshal P-256 key: %v", err)
+	}
+
+	ecKey521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate P-521 key: %v", err)
+	}
+	ecDER521, err := x509.MarshalECPrivateKey(ecKey521)
+	if err != nil {
+		t.Fatalf("failed to marshal P-521 key: %v", err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate Ed25519 key: %v", err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("failed to marshal Ed25519 key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		keyPEM  []byte
+		wantAlg string
+	}{
+		{
+			name:    "RSA PKCS1, no PEM header, defaults to RS256",
+			keyPEM:  pemEncode(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+			wantAlg: "RS256",
+		},
+		{
+			name:    "EC PRIVATE KEY P-256 maps to ES256",
+			keyPEM:  pemEncode(t, "EC PRIVATE KEY", ecDER256),
+			wantAlg: "ES256",
+		},
+		{
+			name:    "EC PRIVATE KEY P-521 maps to ES512",
+			keyPEM:  pemEncode(t, "EC PRIVATE KEY", ecDER521),
+			wantAlg: "ES512",
+		},
+		{
+			name:    "PKCS#8 container dispatches Ed25519 to EdDSA",
+			keyPEM:  pemEncode(t, "PRIVATE KEY", edDER),
+			wantAlg: "EdDSA",
+		},
+		{
+			// The default case assumes RSA regardless of block type, for historical realm keys
+			// that predate EC/Ed25519 support.
+			name:    "unrecognized block type falls back to RSA",
+			keyPEM:  pemEncode(t, "SOMETHING ELSE", x509.MarshalPKCS1PrivateKey(rsaKey)),
+			wantAlg: "RS256",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, signingMethod, err := SigningKeyFromPEM(tt.keyPEM)
+			if err != nil {
+				t.Fatalf("SigningKeyFromPEM() returned error: %v", err)
+			}
+			if got := signingMethod.Alg(); got != tt.wantAlg {
+				t.Errorf("SigningKeyFromPEM() alg = %q, want %q", got, tt.wantAlg)
+			}
+		})
+	}
+}
+
+func TestSigningKeyFromPEMInvalidBlock(t *testing.T) {
+	if _, _, err := SigningKeyFromPEM([]byte("not a PEM block")); err == nil {
+		t.Fatal("SigningKeyFromPEM() expected an error for non-PEM input, got nil")
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kms resolves a crypto.Signer from a URI pointing at a key that lives outside of the
+// local filesystem, such as a PKCS#11 token backed by an HSM or a smartcard. This lets
+// commands that sign JWTs keep realm keys off developer laptops.
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// namedCurveOIDs maps the ASN.1 OIDs found in CKA_EC_PARAMS to their Go curve, mirroring the
+// (unexported) table crypto/x509 uses internally for the same curves.
+var namedCurveOIDs = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// ResolveSigner resolves kmsURI to a crypto.Signer. Currently only the pkcs11: scheme is
+// supported, in the form:
+//
+//	pkcs11:token=astarte;object=realm-key?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234
+//
+// following the PKCS#11 URI scheme described in RFC 7512. Only RSA and EC keys are supported:
+// PKCS#11 has no standard mechanism for Ed25519, so an Ed25519 object errors out rather than
+// being silently mishandled.
+func ResolveSigner(kmsURI string) (crypto.Signer, error) {
+	scheme, rest, ok := strings.Cut(kmsURI, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid kms URI %q: missing scheme", kmsURI)
+	}
+
+	switch scheme {
+	case "pkcs11":
+		return newPKCS11Signer(rest)
+	default:
+		return nil, fmt.Errorf("unsupported kms scheme %q", scheme)
+	}
+}
+
+type pkcs11URI struct {
+	token      string
+	object     string
+	modulePath string
+	pin        string
+	slotID     *uint
+}
+
+func parsePKCS11URI(rest string) (pkcs11URI, error) {
+	var result pkcs11URI
+
+	path, query, _ := strings.Cut(rest, "?")
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return result, fmt.Errorf("invalid pkcs11 URI attribute %q", attr)
+		}
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return result, err
+		}
+
+		switch key {
+		case "token":
+			result.token = value
+		case "object":
+			result.object = value
+		case "slot-id":
+			slotID, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return result, fmt.Errorf("invalid slot-id %q: %w", value, err)
+			}
+			id := uint(slotID)
+			result.slotID = &id
+		}
+	}
+
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return result, err
+		}
+		result.modulePath = values.Get("module-path")
+		result.pin = values.Get("pin-value")
+	}
+
+	if result.modulePath == "" {
+		return result, fmt.Errorf("pkcs11 URI is missing the module-path query argument")
+	}
+	if result.object == "" {
+		return result, fmt.Errorf("pkcs11 URI is missing the object path argument")
+	}
+
+	return result, nil
+}
+
+// pkcs11Signer implements crypto.Signer on top of a key handle living inside a PKCS#11 token.
+type pkcs11Signer struct {
+	ctx       *pkcs11.Ctx
+	session   pkcs11.SessionHandle
+	publicKey crypto.PublicKey
+	object    pkcs11.ObjectHandle
+}
+
+func newPKCS11Signer(rest string) (crypto.Signer, error) {
+	uri, err := parsePKCS11URI(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(uri.modulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load pkcs11 module %q", uri.modulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("could not initialize pkcs11 module: %w", err)
+	}
+
+	slot, err := findSlot(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, fmt.Errorf("could not open pkcs11 session: %w", err)
+	}
+
+	if uri.pin != "" {
+		if err := ctx.Login(session, pkcs11.CKU_USER, uri.pin); err != nil {
+			return nil, fmt.Errorf("could not login to pkcs11 token: %w", err)
+		}
+	}
+
+	privateObject, err := findObject(ctx, session, pkcs11.CKO_PRIVATE_KEY, uri.object)
+	if err != nil {
+		return nil, err
+	}
+
+	publicObject, err := findObject(ctx, session, pkcs11.CKO_PUBLIC_KEY, uri.object)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := publicKeyFromObject(ctx, session, publicObject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkcs11Signer{ctx: ctx, session: session, publicKey: publicKey, object: privateObject}, nil
+}
+
+func findSlot(ctx *pkcs11.Ctx, uri pkcs11URI) (uint, error) {
+	if uri.slotID != nil {
+		return *uri.slotID, nil
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("could not list pkcs11 slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if uri.token == "" || tokenInfo.Label == uri.token {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no pkcs11 token found matching label %q", uri.token)
+}
+
+func findObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("could not look up pkcs11 object %q: %w", label, err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objects, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, fmt.Errorf("could not look up pkcs11 object %q: %w", label, err)
+	}
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("no pkcs11 object found with label %q", label)
+	}
+
+	return objects[0], nil
+}
+
+// Public implements crypto.Signer.
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign implements crypto.Signer, delegating the signature operation to the PKCS#11 token.
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, err := signMechanism(s.publicKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.object); err != nil {
+		return nil, fmt.Errorf("could not initialize pkcs11 signing operation: %w", err)
+	}
+
+	if mechanism.Mechanism == pkcs11.CKM_RSA_PKCS {
+		// CKM_RSA_PKCS only PKCS#1 v1.5-pads and signs whatever bytes it's given, so the
+		// DigestInfo prefix crypto/rsa.SignPKCS1v15 would normally add has to be prepended here.
+		digest = append(append([]byte{}, sha256DigestInfoPrefix...), digest...)
+	}
+
+	// For CKM_ECDSA, PKCS#11 returns the raw r||s concatenation, which is also the format
+	// jwt.SigningMethodECDSA expects, so no further conversion is needed here.
+	return s.ctx.Sign(s.session, digest)
+}
+
+// sha256DigestInfoPrefix is the DER encoding of the DigestInfo ASN.1 structure's
+// AlgorithmIdentifier for SHA-256, as defined by RFC 8017 section 9.2 note 1. CKM_RSA_PKCS
+// expects callers to prepend this to the digest themselves, unlike CKM_SHA256_RSA_PKCS, which
+// hashes internally and would double-hash a pre-computed crypto.Signer digest.
+var sha256DigestInfoPrefix = []byte{
+	0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+}
+
+func signMechanism(publicKey crypto.PublicKey, opts crypto.SignerOpts) (*pkcs11.Mechanism, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			params := pkcs11.NewPSSParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, 32)
+			return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), nil
+		}
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), nil
+	case *ecdsa.PublicKey:
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T for pkcs11 signing", publicKey)
+	}
+}
+
+func publicKeyFromObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, object, template)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pkcs11 public key attributes: %w", err)
+	}
+
+	var modulus, exponent, ecPoint, ecParams []byte
+	for _, attr := range attrs {
+		switch attr.Type {
+		case pkcs11.CKA_MODULUS:
+			modulus = attr.Value
+		case pkcs11.CKA_PUBLIC_EXPONENT:
+			exponent = attr.Value
+		case pkcs11.CKA_EC_POINT:
+			ecPoint = attr.Value
+		case pkcs11.CKA_EC_PARAMS:
+			ecParams = attr.Value
+		}
+	}
+
+	if len(modulus) > 0 {
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(new(big.Int).SetBytes(exponent).Int64()),
+		}, nil
+	}
+
+	if len(ecPoint) > 0 {
+		curve, err := curveFromASN1Params(ecParams)
+		if err != nil {
+			return nil, err
+		}
+
+		// CKA_EC_POINT is DER-encoded OCTET STRING wrapping the uncompressed point.
+		var octet []byte
+		if _, err := asn1.Unmarshal(ecPoint, &octet); err != nil {
+			return nil, fmt.Errorf("could not decode pkcs11 EC point: %w", err)
+		}
+
+		x, y := elliptic.Unmarshal(curve, octet)
+		if x == nil {
+			return nil, fmt.Errorf("could not parse pkcs11 EC point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported pkcs11 public key object: only RSA and EC keys are supported (Ed25519 has no standard PKCS#11 mechanism)")
+}
+
+func curveFromASN1Params(params []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("could not decode pkcs11 EC params: %w", err)
+	}
+
+	curve, ok := namedCurveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported EC curve OID %v", oid)
+	}
+
+	return curve, nil
+}
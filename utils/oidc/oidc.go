@@ -0,0 +1,394 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oidc lets astartectl authenticate against an OIDC provider (e.g. Keycloak or Dex)
+// instead of minting JWTs from a local realm key, for setups where operators authenticate with
+// their own identity rather than a shared realm private key.
+package oidc
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	astartectlutils "github.com/astarte-platform/astartectl/utils"
+)
+
+// Discovery is the subset of the OIDC discovery document (RFC 8414 /
+// .well-known/openid-configuration) astartectl needs to authenticate.
+type Discovery struct {
+	Issuer                      string `json:"issuer"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+// Discover fetches and parses issuer's discovery document.
+func Discover(issuer string) (*Discovery, error) {
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+
+	resp, err := http.Get(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery document request to %s failed with status %s", discoveryURL, resp.Status)
+	}
+
+	var discovery Discovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("could not parse OIDC discovery document: %w", err)
+	}
+
+	return &discovery, nil
+}
+
+// TokenSet is the set of tokens returned by the token endpoint, cached on disk so astartectl
+// doesn't have to prompt for a new login on every invocation.
+type TokenSet struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+func (t TokenSet) expired() bool {
+	// Refresh a bit ahead of the actual expiry, to avoid racing a request against the server.
+	return time.Now().UTC().Unix() >= t.ExpiresAt-30
+}
+
+// Config identifies the OIDC provider and client astartectl should authenticate as.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
+// Token returns a valid bearer token for Config, authenticating via the device code flow and
+// caching the result under $XDG_CACHE_HOME/astartectl, or transparently refreshing a cached
+// token that's close to expiring.
+func (c Config) Token() (string, error) {
+	discovery, err := Discover(c.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	if cached, err := c.loadCachedToken(); err == nil {
+		if !cached.expired() {
+			return cached.AccessToken, nil
+		}
+		if cached.RefreshToken != "" {
+			refreshed, err := c.refreshToken(discovery, cached.RefreshToken)
+			if err == nil {
+				c.saveCachedToken(refreshed)
+				return refreshed.AccessToken, nil
+			}
+			// Fall through to a full device code flow if the refresh token was rejected.
+		}
+	}
+
+	tokenSet, err := c.deviceCodeFlow(discovery)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.saveCachedToken(tokenSet); err != nil {
+		return "", err
+	}
+
+	return tokenSet.AccessToken, nil
+}
+
+// deviceAuthorizationResponse is the response of the device authorization endpoint, as defined
+// by RFC 8628.
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (c Config) deviceCodeFlow(discovery *Discovery) (TokenSet, error) {
+	if discovery.DeviceAuthorizationEndpoint == "" {
+		return TokenSet{}, errors.New("OIDC provider does not support the device authorization grant")
+	}
+
+	deviceAuthForm := url.Values{
+		"client_id": {c.ClientID},
+	}
+	if c.ClientSecret != "" {
+		deviceAuthForm.Set("client_secret", c.ClientSecret)
+	}
+
+	resp, err := http.PostForm(discovery.DeviceAuthorizationEndpoint, deviceAuthForm)
+	if err != nil {
+		return TokenSet{}, fmt.Errorf("could not start the device authorization flow: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var deviceAuth deviceAuthorizationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&deviceAuth); err != nil {
+		return TokenSet{}, fmt.Errorf("could not parse device authorization response: %w", err)
+	}
+
+	if deviceAuth.VerificationURIComplete != "" {
+		fmt.Printf("To authenticate, open %s in a browser\n", deviceAuth.VerificationURIComplete)
+	} else {
+		fmt.Printf("To authenticate, open %s and enter code %s\n", deviceAuth.VerificationURI, deviceAuth.UserCode)
+	}
+
+	interval := time.Duration(deviceAuth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(deviceAuth.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tokenResp, err := c.requestToken(discovery, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {deviceAuth.DeviceCode},
+			"client_id":   {c.ClientID},
+		})
+		if err != nil {
+			return TokenSet{}, err
+		}
+
+		switch tokenResp.Error {
+		case "":
+			tokenSet := tokenSetFromResponse(tokenResp)
+			if err := verifyIDToken(discovery, c.ClientID, tokenSet.IDToken); err != nil {
+				return TokenSet{}, err
+			}
+			return tokenSet, nil
+		case "authorization_pending", "slow_down":
+			continue
+		default:
+			return TokenSet{}, fmt.Errorf("device authorization failed: %s (%s)", tokenResp.Error, tokenResp.ErrorDescription)
+		}
+	}
+
+	return TokenSet{}, errors.New("device authorization flow timed out waiting for the user to authenticate")
+}
+
+func (c Config) refreshToken(discovery *Discovery, refreshToken string) (TokenSet, error) {
+	tokenResp, err := c.requestToken(discovery, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {c.ClientID},
+	})
+	if err != nil {
+		return TokenSet{}, err
+	}
+	if tokenResp.Error != "" {
+		return TokenSet{}, fmt.Errorf("could not refresh token: %s (%s)", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+
+	tokenSet := tokenSetFromResponse(tokenResp)
+	if err := verifyIDToken(discovery, c.ClientID, tokenSet.IDToken); err != nil {
+		return TokenSet{}, err
+	}
+
+	return tokenSet, nil
+}
+
+func (c Config) requestToken(discovery *Discovery, form url.Values) (tokenResponse, error) {
+	if c.ClientSecret != "" {
+		form.Set("client_secret", c.ClientSecret)
+	}
+
+	resp, err := http.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("could not reach the token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokenResp tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return tokenResponse{}, fmt.Errorf("could not parse token endpoint response: %w", err)
+	}
+
+	return tokenResp, nil
+}
+
+// verifyIDToken checks idToken's signature against discovery's JWKS, and that its iss/aud
+// claims identify discovery's issuer and clientID, so a token from the wrong issuer or minted
+// for a different client can't be cached and sent on to the Pairing API as if it were ours.
+// It's a no-op if the provider didn't return an id_token at all.
+func verifyIDToken(discovery *Discovery, clientID, idToken string) error {
+	if idToken == "" {
+		return nil
+	}
+	if discovery.JWKSURI == "" {
+		return errors.New("OIDC provider's discovery document has no jwks_uri, cannot verify id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return publicKeyFromJWKS(discovery.JWKSURI, token)
+	})
+	if err != nil {
+		return fmt.Errorf("could not verify id_token signature: %w", err)
+	}
+	if !token.Valid {
+		return errors.New("id_token is not valid")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return fmt.Errorf("id_token issuer %q does not match the OIDC provider %q", iss, discovery.Issuer)
+	}
+	if !audienceContains(claims, clientID) {
+		return fmt.Errorf("id_token audience does not contain client id %q", clientID)
+	}
+
+	return nil
+}
+
+// audienceContains reports whether claims' aud claim contains expected. RFC 7519 allows aud to
+// be either a single string or an array of strings (decoded by encoding/json as []interface{}).
+func audienceContains(claims jwt.MapClaims, expected string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publicKeyFromJWKS fetches jwksURL and returns the key matching token's kid header, for
+// verifyIDToken to check an id_token's signature against.
+func publicKeyFromJWKS(jwksURL string, token *jwt.Token) (crypto.PublicKey, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, errors.New("id_token has no kid header, cannot select a key out of the JWKS")
+	}
+
+	resp, err := http.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch JWKS from %s: HTTP %d", jwksURL, resp.StatusCode)
+	}
+
+	var jwkSet astartectlutils.JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&jwkSet); err != nil {
+		return nil, err
+	}
+
+	for _, jwk := range jwkSet.Keys {
+		if jwk.Kid == kid {
+			return jwk.PublicKey()
+		}
+	}
+
+	return nil, fmt.Errorf("no key with kid %q found in JWKS at %s", kid, jwksURL)
+}
+
+func tokenSetFromResponse(resp tokenResponse) TokenSet {
+	return TokenSet{
+		AccessToken:  resp.AccessToken,
+		IDToken:      resp.IDToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresAt:    time.Now().UTC().Unix() + resp.ExpiresIn,
+	}
+}
+
+func (c Config) cacheFilePath() (string, error) {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		cacheHome = filepath.Join(homeDir, ".cache")
+	}
+
+	// Keep one cache entry per issuer/client pair, so switching realms/providers doesn't clobber
+	// another one's cached session.
+	key := sha256.Sum256([]byte(c.Issuer + "|" + c.ClientID))
+	fileName := hex.EncodeToString(key[:]) + ".json"
+
+	return filepath.Join(cacheHome, "astartectl", fileName), nil
+}
+
+func (c Config) loadCachedToken() (TokenSet, error) {
+	path, err := c.cacheFilePath()
+	if err != nil {
+		return TokenSet{}, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TokenSet{}, err
+	}
+
+	var tokenSet TokenSet
+	if err := json.Unmarshal(data, &tokenSet); err != nil {
+		return TokenSet{}, err
+	}
+
+	return tokenSet, nil
+}
+
+func (c Config) saveCachedToken(tokenSet TokenSet) error {
+	path, err := c.cacheFilePath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(tokenSet)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}